@@ -3,12 +3,15 @@ package client
 import (
 	cryptoRand "crypto/rand"
 	"encoding/binary"
+	"errors"
 	utls "github.com/refraction-networking/utls"
 	log "github.com/sirupsen/logrus"
 	"math/big"
 	"math/rand"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cbeuw/Cloak/internal/common"
@@ -16,6 +19,14 @@ import (
 
 const appDataMaxLength = 16401
 
+// hybridClassicalKeyShareLen is the length, in bytes, of the X25519 portion of an
+// X25519Kyber768Draft00 hybrid key share. The remaining bytes are the Kyber768 component.
+const hybridClassicalKeyShareLen = 32
+
+// hybridKyberKeyShareLen is the length, in bytes, of the Kyber768 portion of an
+// X25519Kyber768Draft00 hybrid key share.
+const hybridKyberKeyShareLen = 1184
+
 type clientHelloFields struct {
 	random         []byte
 	sessionId      []byte
@@ -23,14 +34,193 @@ type clientHelloFields struct {
 	serverName     string
 }
 
-type browser int
+// fingerprint identifies a browser/TLS-stack disguise a ClientHello is built to mimic.
+// randomFP and weightedFP are not themselves utls.ClientHelloIDs: they tell pickFingerprint
+// to resolve to one of the concrete fingerprints below.
+type fingerprint int
 
 const (
-	chrome = iota
+	chrome fingerprint = iota
 	firefox
 	safari
+	iosSafari
+	androidChrome
+	edge
+	chrome120
+	firefox120
+	randomFP
+	weightedFP
 )
 
+// clientHelloIDs maps a concrete fingerprint to the utls.ClientHelloID used to build it.
+// randomFP and weightedFP never reach this map; pickFingerprint resolves them first.
+var clientHelloIDs = map[fingerprint]utls.ClientHelloID{
+	chrome:    utls.HelloChrome_Auto,
+	firefox:   utls.HelloFirefox_Auto,
+	safari:    utls.HelloSafari_Auto,
+	iosSafari: utls.HelloIOS_Auto,
+	// Chrome on Android runs the same BoringSSL TLS stack as desktop Chrome, so it produces
+	// the same ClientHello fingerprint; utls' HelloAndroid_11_OkHttp is a different Android
+	// HTTP library (OkHttp) with its own, TLS-1.2-only fingerprint, not Chrome's.
+	androidChrome: utls.HelloChrome_Auto,
+	edge:          utls.HelloEdge_Auto,
+	chrome120:     utls.HelloChrome_120,
+	firefox120:    utls.HelloFirefox_120,
+}
+
+// chromeFamily is the set of fingerprints whose real-world ClientHello offers the hybrid
+// X25519Kyber768Draft00 key share by default, alongside plain X25519.
+var chromeFamily = map[fingerprint]bool{
+	chrome:        true,
+	androidChrome: true,
+	edge:          true,
+	chrome120:     true,
+}
+
+// concreteFingerprints is every fingerprint randomFP/weightedFP may resolve to.
+var concreteFingerprints = []fingerprint{chrome, firefox, safari, iosSafari, androidChrome, edge, chrome120, firefox120}
+
+// fingerprintWeights gives each concrete fingerprint a share of weightedFP's distribution,
+// loosely tracking real-world desktop+mobile browser usage. They need not sum to any
+// particular total; weightedRandomFingerprint normalises against their sum.
+var fingerprintWeights = map[fingerprint]int{
+	chrome:        40,
+	chrome120:     20,
+	safari:        15,
+	iosSafari:     8,
+	firefox:       7,
+	firefox120:    5,
+	edge:          4,
+	androidChrome: 1,
+}
+
+// fingerprintCache remembers, per SessionID, the fingerprint a random/weighted selection
+// resolved to, so reconnects within the same Cloak session keep presenting the same browser
+// rather than a censor observing one client rotating fingerprints mid-session. Entries older
+// than fingerprintCacheTTL are swept out by pruneFingerprintCache so a long-running client
+// doesn't leak one entry per SessionID it's ever seen.
+var fingerprintCache sync.Map // sessionId uint32 -> fingerprintCacheEntry
+
+// fingerprintCacheEntry is fingerprintCache's value type: the resolved fingerprint plus when it
+// was picked, so pruneFingerprintCache knows whether it's stale.
+type fingerprintCacheEntry struct {
+	fp       fingerprint
+	pickedAt time.Time
+}
+
+// fingerprintCacheTTL is how long a SessionID's resolved fingerprint is remembered. A reconnect
+// after this window picks a fresh fingerprint rather than being treated as the same session.
+const fingerprintCacheTTL = 24 * time.Hour
+
+// fingerprintCacheSweepInterval bounds how often pickFingerprint bothers walking the whole
+// cache to prune stale entries, rather than doing it on every single cache miss.
+const fingerprintCacheSweepInterval = time.Hour
+
+var lastFingerprintCacheSweep atomic.Int64 // UnixNano; zero value means "never swept"
+
+// pickFingerprint resolves configured to a concrete fingerprint. For randomFP/weightedFP it
+// draws a new fingerprint the first time it sees sessionId, then reuses that choice for every
+// later call with the same sessionId until fingerprintCacheTTL elapses.
+func pickFingerprint(configured fingerprint, sessionId uint32) fingerprint {
+	if configured != randomFP && configured != weightedFP {
+		return configured
+	}
+	now := time.Now()
+	if cached, ok := fingerprintCache.Load(sessionId); ok {
+		entry := cached.(fingerprintCacheEntry)
+		if now.Sub(entry.pickedAt) < fingerprintCacheTTL {
+			return entry.fp
+		}
+		fingerprintCache.Delete(sessionId)
+	}
+	var picked fingerprint
+	if configured == weightedFP {
+		picked = weightedRandomFingerprint()
+	} else {
+		picked = concreteFingerprints[randInt(len(concreteFingerprints))]
+	}
+	fingerprintCache.Store(sessionId, fingerprintCacheEntry{fp: picked, pickedAt: now})
+	pruneFingerprintCache(now)
+	return picked
+}
+
+// pruneFingerprintCache removes fingerprintCache entries older than fingerprintCacheTTL. It
+// only actually walks the map once per fingerprintCacheSweepInterval, so the cheap common case
+// (no sweep due yet) is a single atomic load.
+func pruneFingerprintCache(now time.Time) {
+	last := lastFingerprintCacheSweep.Load()
+	if now.Sub(time.Unix(0, last)) < fingerprintCacheSweepInterval {
+		return
+	}
+	if !lastFingerprintCacheSweep.CompareAndSwap(last, now.UnixNano()) {
+		return // another goroutine is already sweeping
+	}
+	fingerprintCache.Range(func(key, value interface{}) bool {
+		if now.Sub(value.(fingerprintCacheEntry).pickedAt) >= fingerprintCacheTTL {
+			fingerprintCache.Delete(key)
+		}
+		return true
+	})
+}
+
+// FingerprintID is how a fingerprint is named in client config, e.g. `Fingerprint: "random"`
+// in a config file. It's resolved to the internal fingerprint type via fingerprintFromID.
+type FingerprintID string
+
+const (
+	FingerprintChrome        FingerprintID = "chrome"
+	FingerprintFirefox       FingerprintID = "firefox"
+	FingerprintSafari        FingerprintID = "safari"
+	FingerprintIOSSafari     FingerprintID = "ios_safari"
+	FingerprintAndroidChrome FingerprintID = "android_chrome"
+	FingerprintEdge          FingerprintID = "edge"
+	FingerprintChrome120     FingerprintID = "chrome_120"
+	FingerprintFirefox120    FingerprintID = "firefox_120"
+	FingerprintRandom        FingerprintID = "random"
+	FingerprintWeighted      FingerprintID = "weighted"
+)
+
+var fingerprintsByID = map[FingerprintID]fingerprint{
+	FingerprintChrome:        chrome,
+	FingerprintFirefox:       firefox,
+	FingerprintSafari:        safari,
+	FingerprintIOSSafari:     iosSafari,
+	FingerprintAndroidChrome: androidChrome,
+	FingerprintEdge:          edge,
+	FingerprintChrome120:     chrome120,
+	FingerprintFirefox120:    firefox120,
+	FingerprintRandom:        randomFP,
+	FingerprintWeighted:      weightedFP,
+}
+
+// fingerprintFromID resolves a config-provided FingerprintID to the internal fingerprint,
+// defaulting to chrome (the historical, pre-config behaviour) for an empty or unrecognised ID.
+// The returned value may itself be randomFP or weightedFP; it is not yet resolved to a
+// concrete fingerprint, that's pickFingerprint's job once a SessionID is known.
+func fingerprintFromID(id FingerprintID) fingerprint {
+	if fp, ok := fingerprintsByID[id]; ok {
+		return fp
+	}
+	return chrome
+}
+
+func weightedRandomFingerprint() fingerprint {
+	total := 0
+	for _, w := range fingerprintWeights {
+		total += w
+	}
+	r := randInt(total)
+	for _, fp := range concreteFingerprints {
+		w := fingerprintWeights[fp]
+		if r < w {
+			return fp
+		}
+		r -= w
+	}
+	// unreachable as long as fingerprintWeights covers concreteFingerprints
+	return chrome
+}
+
 func generateSNI(serverName string) []byte {
 	serverNameListLength := make([]byte, 2)
 	binary.BigEndian.PutUint16(serverNameListLength, uint16(len(serverName)+3))
@@ -47,7 +237,10 @@ func generateSNI(serverName string) []byte {
 
 type DirectTLS struct {
 	*common.TLSConn
-	browser browser
+	// fingerprint starts out as the configured fingerprint, which may be randomFP or
+	// weightedFP. ObfsHandshake replaces it with what pickFingerprint resolved it to for the
+	// session, the concrete fingerprint this connection's ClientHello is built with.
+	fingerprint fingerprint
 }
 
 var topLevelDomains = []string{"com", "net", "org", "it", "fr", "me", "ru", "cn", "es", "tr", "top", "xyz", "info"}
@@ -77,56 +270,90 @@ func randInt(n int) int {
 	return rand.Intn(n)
 }
 
-func buildClientHello(browser browser, fields clientHelloFields) ([]byte, error) {
+func buildClientHello(fp fingerprint, fields clientHelloFields) ([]byte, error) {
+	raw, _, err := buildClientHelloWithReference(fp, fields)
+	return raw, err
+}
+
+// buildClientHelloWithReference does the work of buildClientHello, additionally returning
+// reference: the raw ClientHello utls would send for this fingerprint with fields.random and
+// fields.sessionId already applied, but before the key share is touched. Tests diff raw against
+// reference to confirm we only ever change the key share's key_exchange bytes, never anything
+// utls itself controls (extension order, GREASE placement, padding) - the part a utls upgrade
+// could silently change underneath us.
+func buildClientHelloWithReference(fp fingerprint, fields clientHelloFields) (raw, reference []byte, err error) {
 	// We don't use utls to handle connections (as it'll attempt a real TLS negotiation)
 	// We only want it to build the ClientHello locally
 	fakeConn := net.TCPConn{}
-	var helloID utls.ClientHelloID
-	switch browser {
-	case chrome:
-		helloID = utls.HelloChrome_Auto
-	case firefox:
-		helloID = utls.HelloFirefox_Auto
-	case safari:
-		helloID = utls.HelloSafari_Auto
+	helloID, ok := clientHelloIDs[fp]
+	if !ok {
+		return nil, nil, errors.New("buildClientHello: unresolved or unknown fingerprint")
 	}
 
 	uclient := utls.UClient(&fakeConn, &utls.Config{ServerName: fields.serverName}, helloID)
 	if err := uclient.BuildHandshakeState(); err != nil {
-		return []byte{}, err
+		return nil, nil, err
 	}
 	if err := uclient.SetClientRandom(fields.random); err != nil {
-		return []byte{}, err
+		return nil, nil, err
 	}
 
 	uclient.HandshakeState.Hello.SessionId = make([]byte, 32)
 	copy(uclient.HandshakeState.Hello.SessionId, fields.sessionId)
 
-	// Find the X25519 key share and overwrite it
+	if err := uclient.BuildHandshakeState(); err != nil {
+		return nil, nil, err
+	}
+	reference = append([]byte(nil), uclient.HandshakeState.Hello.Raw...)
+
+	// Find the key share to hide our ciphertext in. Chrome now sends a hybrid
+	// X25519Kyber768Draft00 share by default, so if one is offered we prefer it over the
+	// plain X25519 share to keep the ClientHello indistinguishable from a real Chrome one.
 	var extIndex int
-	var keyShareIndex int
+	var x25519Index = -1
+	var hybridIndex = -1
 	for i, ext := range uclient.Extensions {
 		ext, ok := ext.(*utls.KeyShareExtension)
 		if ok {
 			extIndex = i
 			for j, keyShare := range ext.KeyShares {
-				if keyShare.Group == utls.X25519 {
-					keyShareIndex = j
+				switch keyShare.Group {
+				case utls.X25519:
+					x25519Index = j
+				case utls.X25519Kyber768Draft00:
+					hybridIndex = j
 				}
 			}
 		}
 	}
-	copy(uclient.Extensions[extIndex].(*utls.KeyShareExtension).KeyShares[keyShareIndex].Data, fields.x25519KeyShare)
+
+	keyShares := uclient.Extensions[extIndex].(*utls.KeyShareExtension).KeyShares
+	switch {
+	case hybridIndex >= 0 && chromeFamily[fp]:
+		// Classical component carries the ciphertext exactly as the plain X25519 share
+		// would; the Kyber component is filled with random bytes so it's indistinguishable
+		// from a real post-quantum share to a passive observer.
+		data := keyShares[hybridIndex].Data
+		copy(data[:hybridClassicalKeyShareLen], fields.x25519KeyShare)
+		if _, err := cryptoRand.Read(data[hybridClassicalKeyShareLen:]); err != nil {
+			return nil, nil, err
+		}
+	case x25519Index >= 0:
+		copy(keyShares[x25519Index].Data, fields.x25519KeyShare)
+	default:
+		return nil, nil, errors.New("buildClientHello: no usable key share group in ClientHello")
+	}
 
 	if err := uclient.BuildHandshakeState(); err != nil {
-		return []byte{}, err
+		return nil, nil, err
 	}
-	return uclient.HandshakeState.Hello.Raw, nil
+	return uclient.HandshakeState.Hello.Raw, reference, nil
 }
 
-// Handshake handles the TLS handshake for a given conn and returns the sessionKey
-// if the server proceed with Cloak authentication
-func (tls *DirectTLS) Handshake(rawConn net.Conn, authInfo AuthInfo) (sessionKey [32]byte, err error) {
+// ObfsHandshake implements Transport. It performs the TLS handshake for a given conn and
+// returns the resulting net.Conn along with the sessionKey, if the server proceeds with Cloak
+// authentication.
+func (tls *DirectTLS) ObfsHandshake(rawConn net.Conn, authInfo AuthInfo) (conn net.Conn, sessionKey [32]byte, err error) {
 	payload, sharedSecret := makeAuthenticationPayload(authInfo)
 
 	// random is marshalled ephemeral pub key 32 bytes
@@ -142,8 +369,10 @@ func (tls *DirectTLS) Handshake(rawConn net.Conn, authInfo AuthInfo) (sessionKey
 		fields.serverName = randomServerName()
 	}
 
+	tls.fingerprint = pickFingerprint(tls.fingerprint, authInfo.SessionId)
+
 	var ch []byte
-	ch, err = buildClientHello(tls.browser, fields)
+	ch, err = buildClientHello(tls.fingerprint, fields)
 	if err != nil {
 		return
 	}
@@ -178,6 +407,12 @@ func (tls *DirectTLS) Handshake(rawConn net.Conn, authInfo AuthInfo) (sessionKey
 			return
 		}
 	}
-	return sessionKey, nil
+	return tls.TLSConn, sessionKey, nil
+}
 
+// Handshake is kept for callers written against the pre-Transport API; it's a thin wrapper
+// around ObfsHandshake that discards the net.Conn (tls itself is already one, via TLSConn).
+func (tls *DirectTLS) Handshake(rawConn net.Conn, authInfo AuthInfo) (sessionKey [32]byte, err error) {
+	_, sessionKey, err = tls.ObfsHandshake(rawConn, authInfo)
+	return
 }
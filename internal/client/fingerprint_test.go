@@ -0,0 +1,159 @@
+package client
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func testClientHelloFields() clientHelloFields {
+	random := make([]byte, 32)
+	sessionId := make([]byte, 32)
+	x25519KeyShare := make([]byte, 32)
+	for i := range random {
+		random[i] = byte(i)
+	}
+	for i := range sessionId {
+		sessionId[i] = byte(i + 1)
+	}
+	for i := range x25519KeyShare {
+		x25519KeyShare[i] = byte(i + 2)
+	}
+	return clientHelloFields{
+		random:         random,
+		sessionId:      sessionId,
+		x25519KeyShare: x25519KeyShare,
+		serverName:     "www.example.com",
+	}
+}
+
+// TestBuildClientHelloAllFingerprints checks that every concrete fingerprint produces a
+// non-empty ClientHello with our SessionId correctly stamped in, whether or not it ends up
+// carrying the ciphertext in a hybrid PQ key share.
+func TestBuildClientHelloAllFingerprints(t *testing.T) {
+	fields := testClientHelloFields()
+	for _, fp := range concreteFingerprints {
+		fp := fp
+		t.Run(clientHelloIDs[fp].Client, func(t *testing.T) {
+			raw, err := buildClientHello(fp, fields)
+			if err != nil {
+				t.Fatalf("buildClientHello(%v) returned error: %v", fp, err)
+			}
+			if len(raw) == 0 {
+				t.Fatalf("buildClientHello(%v) returned an empty ClientHello", fp)
+			}
+			if !bytes.Contains(raw, fields.sessionId) {
+				t.Errorf("buildClientHello(%v): SessionId not found in raw ClientHello", fp)
+			}
+		})
+	}
+}
+
+// TestBuildClientHelloMatchesUtlsReference is the golden-byte test: for every concrete
+// fingerprint, it diffs buildClientHello's output against buildClientHelloWithReference's
+// reference bytes (what utls itself would send for that fingerprint, with our random and
+// SessionId already applied but before we touch the key share). The only bytes we intend to
+// change are the key share's key_exchange data: the whole 32-byte X25519 share, or for a hybrid
+// share its leading hybridClassicalKeyShareLen bytes plus the hybridKyberKeyShareLen random
+// bytes after them - anything else
+// differing means either we touched something we shouldn't have, or a utls upgrade moved the
+// key share, reordered extensions, or otherwise changed the wire format underneath us.
+func TestBuildClientHelloMatchesUtlsReference(t *testing.T) {
+	fields := testClientHelloFields()
+	for _, fp := range concreteFingerprints {
+		fp := fp
+		t.Run(clientHelloIDs[fp].Client, func(t *testing.T) {
+			raw, reference, err := buildClientHelloWithReference(fp, fields)
+			if err != nil {
+				t.Fatalf("buildClientHelloWithReference(%v) returned error: %v", fp, err)
+			}
+			if len(raw) != len(reference) {
+				t.Fatalf("buildClientHello(%v) changed the ClientHello length: got %d, utls reference is %d", fp, len(raw), len(reference))
+			}
+
+			// Locate the substituted window by searching for the known pattern we wrote into
+			// it, rather than scanning for the first/last byte that differs from reference:
+			// reference's key share is utls' own randomly-generated ephemeral key, so a
+			// boundary byte can coincidentally match fields.x25519KeyShare and shrink an
+			// inequality-scanned window below its true length.
+			keyShareStart := bytes.Index(raw, fields.x25519KeyShare)
+			if keyShareStart == -1 {
+				t.Fatalf("buildClientHello(%v): fields.x25519KeyShare not found in output, ciphertext was never written", fp)
+			}
+			keyShareLen := hybridClassicalKeyShareLen
+			if keyShareStart+hybridClassicalKeyShareLen+hybridKyberKeyShareLen <= len(raw) &&
+				!bytes.Equal(raw[keyShareStart+hybridClassicalKeyShareLen:keyShareStart+hybridClassicalKeyShareLen+hybridKyberKeyShareLen],
+					reference[keyShareStart+hybridClassicalKeyShareLen:keyShareStart+hybridClassicalKeyShareLen+hybridKyberKeyShareLen]) {
+				keyShareLen = hybridClassicalKeyShareLen + hybridKyberKeyShareLen
+			}
+
+			if !bytes.Equal(raw[:keyShareStart], reference[:keyShareStart]) ||
+				!bytes.Equal(raw[keyShareStart+keyShareLen:], reference[keyShareStart+keyShareLen:]) {
+				t.Errorf("buildClientHello(%v): bytes outside the key share window [%d,%d) differ from the utls reference", fp, keyShareStart, keyShareStart+keyShareLen)
+			}
+		})
+	}
+}
+
+// TestPickFingerprintReusesPerSession verifies that random/weighted selections are sticky per
+// SessionID, so a reconnect doesn't present a different browser mid-session.
+func TestPickFingerprintReusesPerSession(t *testing.T) {
+	for _, configured := range []fingerprint{randomFP, weightedFP} {
+		const sessionId = 0xdeadbeef
+		first := pickFingerprint(configured, sessionId)
+		for i := 0; i < 5; i++ {
+			got := pickFingerprint(configured, sessionId)
+			if got != first {
+				t.Fatalf("pickFingerprint(%v, %d) = %v on call %d, want %v (sticky selection)", configured, sessionId, got, i, first)
+			}
+		}
+	}
+}
+
+// TestPickFingerprintConcretePassthrough verifies that an already-concrete fingerprint is
+// never perturbed by pickFingerprint, regardless of SessionID.
+func TestPickFingerprintConcretePassthrough(t *testing.T) {
+	for _, fp := range concreteFingerprints {
+		if got := pickFingerprint(fp, 1234); got != fp {
+			t.Errorf("pickFingerprint(%v, 1234) = %v, want %v unchanged", fp, got, fp)
+		}
+	}
+}
+
+// TestPickFingerprintExpiresStaleEntries verifies fingerprintCache entries older than
+// fingerprintCacheTTL are treated as a fresh session (a new fingerprint may be picked) rather
+// than kept forever.
+func TestPickFingerprintExpiresStaleEntries(t *testing.T) {
+	const sessionId uint32 = 0xfeedface
+	fingerprintCache.Store(sessionId, fingerprintCacheEntry{fp: firefox, pickedAt: time.Now().Add(-2 * fingerprintCacheTTL)})
+
+	got := pickFingerprint(randomFP, sessionId)
+
+	cached, ok := fingerprintCache.Load(sessionId)
+	if !ok {
+		t.Fatal("pickFingerprint did not store a fresh entry for an expired SessionID")
+	}
+	entry := cached.(fingerprintCacheEntry)
+	if entry.fp != got {
+		t.Errorf("stored entry fp = %v, want %v (pickFingerprint's return value)", entry.fp, got)
+	}
+	if time.Since(entry.pickedAt) > time.Minute {
+		t.Errorf("stored entry pickedAt = %v, want close to now", entry.pickedAt)
+	}
+}
+
+func TestFingerprintFromID(t *testing.T) {
+	cases := map[FingerprintID]fingerprint{
+		FingerprintChrome:      chrome,
+		FingerprintFirefox120:  firefox120,
+		FingerprintRandom:      randomFP,
+		FingerprintWeighted:    weightedFP,
+		FingerprintID("bogus"): chrome,
+		FingerprintID(""):      chrome,
+	}
+	for id, want := range cases {
+		if got := fingerprintFromID(id); got != want {
+			t.Errorf("fingerprintFromID(%q) = %v, want %v", id, got, want)
+		}
+	}
+}
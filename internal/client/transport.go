@@ -0,0 +1,53 @@
+package client
+
+import (
+	"fmt"
+	"net"
+)
+
+// Transport performs the obfuscated handshake that disguises a Cloak connection as some real
+// protocol to an observer, then hands back a net.Conn ready for the multiplexed Cloak session
+// plus the sessionKey the server derived during authentication.
+//
+// DirectTLS wraps the handshake in a TLS 1.3 ClientHello; other implementations can mimic an
+// entirely different front protocol (e.g. WebSocketUpgrade) without the dispatcher or the
+// session logic above it needing to change.
+type Transport interface {
+	ObfsHandshake(rawConn net.Conn, authInfo AuthInfo) (net.Conn, [32]byte, error)
+}
+
+// TransportKind selects which Transport implementation NewTransport builds.
+type TransportKind string
+
+const (
+	TransportDirectTLS TransportKind = "direct_tls"
+	TransportWebSocket TransportKind = "websocket"
+)
+
+// NewTransport builds the Transport configured by kind. fp selects the utls fingerprint used
+// when kind is TransportDirectTLS; it's ignored otherwise. Adding a new front protocol means
+// adding a case here and a Transport implementation elsewhere in this package; the dispatcher
+// calling ObfsHandshake never needs to change.
+func NewTransport(kind TransportKind, wsPath string, fp FingerprintID) (Transport, error) {
+	switch kind {
+	case TransportDirectTLS, "":
+		return &DirectTLS{fingerprint: fingerprintFromID(fp)}, nil
+	case TransportWebSocket:
+		return &WebSocketUpgrade{Path: wsPath}, nil
+	default:
+		return nil, fmt.Errorf("client: unknown transport kind %q", kind)
+	}
+}
+
+// Dispatch is the client-side entry point: it builds the Transport configured by kind and runs
+// its ObfsHandshake over rawConn. This is what callers establishing a new Cloak connection
+// should use instead of constructing a DirectTLS (or any other Transport) directly, so that
+// switching disguises is a config change rather than a code change.
+func Dispatch(rawConn net.Conn, authInfo AuthInfo, kind TransportKind, wsPath string, fp FingerprintID) (net.Conn, [32]byte, error) {
+	transport, err := NewTransport(kind, wsPath, fp)
+	if err != nil {
+		var zero [32]byte
+		return nil, zero, err
+	}
+	return transport.ObfsHandshake(rawConn, authInfo)
+}
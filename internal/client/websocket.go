@@ -0,0 +1,105 @@
+package client
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+
+	"github.com/cbeuw/Cloak/internal/common"
+)
+
+// wsMagicGUID is the fixed GUID RFC 6455 uses to derive Sec-WebSocket-Accept from
+// Sec-WebSocket-Key. https://datatracker.ietf.org/doc/html/rfc6455#section-1.3
+const wsMagicGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocketUpgrade is a Transport that disguises the Cloak authentication handshake as a
+// WebSocket upgrade request, the same way DirectTLS disguises it as a TLS ClientHello. The
+// 16-byte Sec-WebSocket-Key a real client would pick at random instead carries the start of
+// our authentication ciphertext, with the remainder riding along in a Cookie header — both
+// places a real reverse proxy or CDN would leave untouched.
+type WebSocketUpgrade struct {
+	// Path is the HTTP request path used for the upgrade request, e.g. "/ws". Defaults to "/".
+	Path string
+}
+
+// ObfsHandshake implements Transport.
+func (ws *WebSocketUpgrade) ObfsHandshake(rawConn net.Conn, authInfo AuthInfo) (conn net.Conn, sessionKey [32]byte, err error) {
+	payload, sharedSecret := makeAuthenticationPayload(authInfo)
+
+	wsKey := base64.StdEncoding.EncodeToString(payload.ciphertextWithTag[0:16])
+	cookie := base64.StdEncoding.EncodeToString(payload.ciphertextWithTag[16:64])
+
+	path := ws.Path
+	if path == "" {
+		path = "/"
+	}
+	req := fmt.Sprintf(
+		"GET %s HTTP/1.1\r\n"+
+			"Host: %s\r\n"+
+			"Upgrade: websocket\r\n"+
+			"Connection: Upgrade\r\n"+
+			"Sec-WebSocket-Key: %s\r\n"+
+			"Sec-WebSocket-Version: 13\r\n"+
+			"Cookie: sid=%s\r\n"+
+			"\r\n",
+		path, authInfo.MockDomain, wsKey, cookie,
+	)
+	if _, err = rawConn.Write([]byte(req)); err != nil {
+		return
+	}
+	log.Trace("websocket upgrade request sent successfully")
+
+	resp, err := http.ReadResponse(bufio.NewReader(rawConn), nil)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != wsAcceptKey(wsKey) {
+		err = errors.New("websocket: server did not proceed with Cloak authentication")
+		return
+	}
+
+	var sidCookie *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == "sid" {
+			sidCookie = c
+			break
+		}
+	}
+	if sidCookie == nil {
+		err = errors.New("websocket: missing sid cookie in upgrade response")
+		return
+	}
+	encrypted, err := base64.StdEncoding.DecodeString(sidCookie.Value)
+	if err != nil {
+		return
+	}
+	if len(encrypted) != 60 {
+		err = errors.New("websocket: malformed sid cookie")
+		return
+	}
+	nonce := encrypted[0:12]
+	ciphertextWithTag := encrypted[12:60]
+
+	sessionKeySlice, err := common.AESGCMDecrypt(nonce, sharedSecret[:], ciphertextWithTag)
+	if err != nil {
+		return
+	}
+	copy(sessionKey[:], sessionKeySlice)
+	return rawConn, sessionKey, nil
+}
+
+// wsAcceptKey computes the Sec-WebSocket-Accept value a spec-compliant server returns for a
+// given Sec-WebSocket-Key, so we can tell a genuine upgrade response from a censor's probe.
+func wsAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key))
+	h.Write([]byte(wsMagicGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
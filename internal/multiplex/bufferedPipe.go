@@ -3,166 +3,263 @@
 package multiplex
 
 import (
-	"bytes"
 	"errors"
-	log "github.com/sirupsen/logrus"
 	"io"
 	"sync"
 	"time"
 )
 
-const BUF_SIZE_LIMIT = 1 << 20 * 500
+// defaultRingCapacity is how large a stream's ring buffer is by default. Unlike the old
+// bytes.Buffer-backed pipe, which grew on demand up to BUF_SIZE_LIMIT, this is allocated once
+// and never grows; Write blocks once it's full, giving the frame demuxer real backpressure.
+const defaultRingCapacity = 1 << 20 // 1 MiB
 
 var ErrTimeout = errors.New("deadline exceeded")
 
 // The point of a bufferedPipe is that Read() will block until data is available
+//
+// It's backed by a fixed-size ring buffer rather than an ever-growing bytes.Buffer: buf holds
+// capacity bytes, of which the count starting at head are valid, and writes land starting at
+// tail. notEmpty and notFull are closed (and immediately replaced) whenever their condition may
+// have become true, which lets Read/Write/WriteTo wait on them with a select alongside
+// time.After instead of needing a sync.Cond.
 type bufferedPipe struct {
-	// only alloc when on first Read or Write
-	buf *bytes.Buffer
+	mu sync.Mutex
+
+	buf      []byte
+	capacity int
+	head     int
+	tail     int
+	count    int
+
+	closed bool
+
+	notEmpty chan struct{}
+	notFull  chan struct{}
 
-	closed    bool
-	rwCond    *sync.Cond
 	rDeadline time.Time
 	wtTimeout time.Duration
 }
 
 func NewBufferedPipe() *bufferedPipe {
-	p := &bufferedPipe{
-		rwCond: sync.NewCond(&sync.Mutex{}),
+	return newBufferedPipeSize(defaultRingCapacity)
+}
+
+func newBufferedPipeSize(capacity int) *bufferedPipe {
+	return &bufferedPipe{
+		buf:      make([]byte, capacity),
+		capacity: capacity,
+		notEmpty: make(chan struct{}),
+		notFull:  make(chan struct{}),
 	}
-	return p
+}
+
+// broadcastNotEmpty and broadcastNotFull must be called with p.mu held. Closing the channel
+// wakes every goroutine currently selecting on it; replacing it means the next waiter blocks on
+// a fresh, unclosed channel rather than firing immediately on the one we just closed.
+func (p *bufferedPipe) broadcastNotEmpty() {
+	close(p.notEmpty)
+	p.notEmpty = make(chan struct{})
+}
+
+func (p *bufferedPipe) broadcastNotFull() {
+	close(p.notFull)
+	p.notFull = make(chan struct{})
 }
 
 func (p *bufferedPipe) Read(target []byte) (int, error) {
-	log.Tracef("%p Read entering lock", p)
-	p.rwCond.L.Lock()
-	defer log.Tracef("%p Read exiting lock", p)
-	defer p.rwCond.L.Unlock()
-	if p.buf == nil {
-		p.buf = new(bytes.Buffer)
-	}
-	for {
-		log.Tracef("%p New Read loop cycle", p)
-		if p.closed && p.buf.Len() == 0 {
-			return 0, io.EOF
-		}
+	p.mu.Lock()
+	for p.count == 0 && !p.closed {
 		if !p.rDeadline.IsZero() {
 			d := time.Until(p.rDeadline)
 			if d <= 0 {
+				p.mu.Unlock()
 				return 0, ErrTimeout
 			}
-			time.AfterFunc(d, p.rwCond.Broadcast)
-		}
-		if p.buf.Len() > 0 {
-			break
+			waitCh := p.notEmpty
+			p.mu.Unlock()
+			select {
+			case <-waitCh:
+			case <-time.After(d):
+			}
+			p.mu.Lock()
+			continue
 		}
-		log.Tracef("%p Read waiting for broadcast and exiting lock", p)
-		p.rwCond.Wait()
-		log.Tracef("%p Read was woken up by broadcast and reacquired lock", p)
+		waitCh := p.notEmpty
+		p.mu.Unlock()
+		<-waitCh
+		p.mu.Lock()
+	}
+	if p.count == 0 {
+		p.mu.Unlock()
+		return 0, io.EOF
 	}
-	n, err := p.buf.Read(target)
-	// err will always be nil because we have already verified that buf.Len() != 0
-	log.Tracef("%p Read broadcasting to wake all waiting goroutines", p)
-	p.rwCond.Broadcast()
-	return n, err
+	n := p.readLocked(target)
+	p.mu.Unlock()
+	return n, nil
 }
 
-func (p *bufferedPipe) WriteTo(w io.Writer) (n int64, err error) {
-	log.Tracef("%p WriteTo entering lock", p)
-	p.rwCond.L.Lock()
-	defer log.Tracef("%p WriteTo exiting lock", p)
-	defer p.rwCond.L.Unlock()
-	if p.buf == nil {
-		p.buf = new(bytes.Buffer)
+// readLocked copies out of the ring into target, in at most two copy calls to handle
+// wrap-around, and frees up the space it read. p.mu must be held.
+func (p *bufferedPipe) readLocked(target []byte) int {
+	n := len(target)
+	if n > p.count {
+		n = p.count
+	}
+	first := p.capacity - p.head
+	if first > n {
+		first = n
+	}
+	copy(target[:first], p.buf[p.head:p.head+first])
+	if n > first {
+		copy(target[first:n], p.buf[:n-first])
+	}
+	p.head = (p.head + n) % p.capacity
+	p.count -= n
+	if n > 0 {
+		p.broadcastNotFull()
 	}
+	return n
+}
+
+// WriteTo snapshots the readable region of the ring with a copy, unlocks, then calls w.Write —
+// it does not hold p.mu across the call into w like an earlier version of this method did.
+// That version serialized every concurrent Write behind whatever w.Write (typically a socket)
+// was doing, even with the ring mostly empty, which is exactly the producer-side contention a
+// ring buffer is supposed to avoid. count is only decremented, and head/broadcastNotFull only
+// applied, after w.Write returns successfully, so Write still blocks correctly while the ring is
+// genuinely full; a concurrent Read can't run ahead of WriteTo because the bytes it would read
+// are still counted as unread (p.head/p.count aren't advanced) until the write actually succeeds.
+func (p *bufferedPipe) WriteTo(w io.Writer) (n int64, err error) {
 	for {
-		log.Tracef("%p New WriteTo loop cycle", p)
-		if p.closed && p.buf.Len() == 0 {
-			return 0, io.EOF
-		}
-		if !p.rDeadline.IsZero() {
-			d := time.Until(p.rDeadline)
-			if d <= 0 {
-				return 0, ErrTimeout
-			}
-			if p.wtTimeout == 0 {
-				// if there hasn't been a scheduled broadcast
-				time.AfterFunc(d, p.rwCond.Broadcast)
-			}
-		}
+		p.mu.Lock()
 		if p.wtTimeout != 0 {
 			p.rDeadline = time.Now().Add(p.wtTimeout)
-			time.AfterFunc(p.wtTimeout, p.rwCond.Broadcast)
 		}
-		log.Tracef("%p WriteTo p.buf.Len(): %d", p, p.buf.Len())
-		if p.buf.Len() > 0 {
-			written, er := p.buf.WriteTo(w)
-			n += written
-			if er != nil {
-				log.Tracef("%p WriteTo broadcasting with err %v", p, er)
-				p.rwCond.Broadcast()
-				return n, er
+		for p.count == 0 && !p.closed {
+			if !p.rDeadline.IsZero() {
+				d := time.Until(p.rDeadline)
+				if d <= 0 {
+					p.mu.Unlock()
+					return n, ErrTimeout
+				}
+				waitCh := p.notEmpty
+				p.mu.Unlock()
+				select {
+				case <-waitCh:
+				case <-time.After(d):
+				}
+				p.mu.Lock()
+				continue
 			}
-			log.Tracef("%p WriteTo broadcasting to wake all waiting goroutines", p)
-			p.rwCond.Broadcast()
+			waitCh := p.notEmpty
+			p.mu.Unlock()
+			<-waitCh
+			p.mu.Lock()
+		}
+		if p.count == 0 {
+			p.mu.Unlock()
+			return n, io.EOF
+		}
+
+		first := p.capacity - p.head
+		if first > p.count {
+			first = p.count
+		}
+		second := p.count - first
+
+		chunk := append([]byte(nil), p.buf[p.head:p.head+first]...)
+		if second > 0 {
+			chunk = append(chunk, p.buf[:second]...)
+		}
+		p.mu.Unlock()
+
+		wn, werr := w.Write(chunk)
+		n += int64(wn)
+
+		p.mu.Lock()
+		p.head = (p.head + wn) % p.capacity
+		p.count -= wn
+		p.broadcastNotFull()
+		p.mu.Unlock()
+
+		if werr != nil || wn < len(chunk) {
+			return n, werr
 		}
-		log.Tracef("%p WriteTo waiting for broadcast and exiting lock", p)
-		p.rwCond.Wait()
-		log.Tracef("%p WriteTo was woken up by broadcast and reacquired lock", p)
 	}
 }
 
 func (p *bufferedPipe) Write(input []byte) (int, error) {
-	log.Tracef("%p Write entering lock", p)
-	p.rwCond.L.Lock()
-	defer log.Tracef("%p Write exiting lock", p)
-	defer p.rwCond.L.Unlock()
-	if p.buf == nil {
-		p.buf = new(bytes.Buffer)
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return 0, io.ErrClosedPipe
 	}
-	for {
-		log.Tracef("%p New Write loop cycle", p)
-		if p.closed {
-			return 0, io.ErrClosedPipe
+
+	written := 0
+	for written < len(input) {
+		for p.count == p.capacity && !p.closed {
+			waitCh := p.notFull
+			p.mu.Unlock()
+			<-waitCh
+			p.mu.Lock()
 		}
-		if p.buf.Len() <= BUF_SIZE_LIMIT {
-			// if p.buf gets too large, write() will panic. We don't want this to happen
-			break
+		if p.closed {
+			p.mu.Unlock()
+			return written, io.ErrClosedPipe
 		}
-		log.Tracef("%p Write waiting for broadcast and exiting lock", p)
-		p.rwCond.Wait()
-		log.Tracef("%p Write was woken up by broadcast and reacquired lock", p)
+		written += p.writeLocked(input[written:])
+	}
+	p.mu.Unlock()
+	return written, nil
+}
+
+// writeLocked copies as much of input as currently fits into the ring, in at most two copy
+// calls to handle wrap-around. p.mu must be held.
+func (p *bufferedPipe) writeLocked(input []byte) int {
+	free := p.capacity - p.count
+	n := len(input)
+	if n > free {
+		n = free
+	}
+	first := p.capacity - p.tail
+	if first > n {
+		first = n
+	}
+	copy(p.buf[p.tail:p.tail+first], input[:first])
+	if n > first {
+		copy(p.buf[:n-first], input[first:n])
+	}
+	p.tail = (p.tail + n) % p.capacity
+	p.count += n
+	if n > 0 {
+		p.broadcastNotEmpty()
 	}
-	n, err := p.buf.Write(input)
-	// err will always be nil
-	log.Tracef("%p Write broadcasting to wake all waiting goroutines", p)
-	p.rwCond.Broadcast()
-	return n, err
+	return n
 }
 
 func (p *bufferedPipe) Close() error {
-	log.Tracef("%p Close Entering bufferedPipe rwCond lock", p)
-	p.rwCond.L.Lock()
-	defer log.Tracef("%p Close Exiting bufferedPipe lock", p)
-	defer p.rwCond.L.Unlock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
 	p.closed = true
-	p.rwCond.Broadcast()
+	p.broadcastNotEmpty()
+	p.broadcastNotFull()
 	return nil
 }
 
 func (p *bufferedPipe) SetReadDeadline(t time.Time) {
-	p.rwCond.L.Lock()
-	defer p.rwCond.L.Unlock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
 	p.rDeadline = t
-	p.rwCond.Broadcast()
+	p.broadcastNotEmpty()
 }
 
 func (p *bufferedPipe) SetWriteToTimeout(d time.Duration) {
-	p.rwCond.L.Lock()
-	defer p.rwCond.L.Unlock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
 	p.wtTimeout = d
-	p.rwCond.Broadcast()
+	p.broadcastNotEmpty()
 }
@@ -0,0 +1,194 @@
+package multiplex
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+// blockingWriter blocks inside Write until release is closed, so tests can observe whether
+// WriteTo holds p.mu for the duration of a slow/blocked underlying io.Writer.
+type blockingWriter struct {
+	release chan struct{}
+}
+
+func (w *blockingWriter) Write(b []byte) (int, error) {
+	<-w.release
+	return len(b), nil
+}
+
+func TestBufferedPipeReadWraparound(t *testing.T) {
+	p := newBufferedPipeSize(8)
+	if _, err := p.Write([]byte("abcdefgh")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	first := make([]byte, 4)
+	if _, err := io.ReadFull(p, first); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if string(first) != "abcd" {
+		t.Fatalf("Read = %q, want %q", first, "abcd")
+	}
+	// head is now mid-buffer; this write wraps tail around to the front of the ring
+	if _, err := p.Write([]byte("ijkl")); err != nil {
+		t.Fatalf("Write (wraparound): %v", err)
+	}
+	rest := make([]byte, 8)
+	if _, err := io.ReadFull(p, rest); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if string(rest) != "efghijkl" {
+		t.Fatalf("Read = %q, want %q", rest, "efghijkl")
+	}
+}
+
+func TestBufferedPipeWriteToWraparound(t *testing.T) {
+	p := newBufferedPipeSize(8)
+	if _, err := p.Write([]byte("abcdefgh")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, err := io.ReadFull(p, make([]byte, 4)); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if _, err := p.Write([]byte("ijkl")); err != nil {
+		t.Fatalf("Write (wraparound): %v", err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	var out bytes.Buffer
+	if _, err := p.WriteTo(&out); err != nil && err != io.EOF {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	if got := out.String(); got != "efghijkl" {
+		t.Fatalf("WriteTo wrote %q, want %q", got, "efghijkl")
+	}
+}
+
+// TestWriteToDoesNotBlockConcurrentWrite checks that a Write() to a pipe with plenty of free
+// capacity doesn't have to wait for a concurrent WriteTo to finish an in-flight, blocked
+// w.Write call: WriteTo must release p.mu while it's inside w.Write, not hold it for the whole
+// call.
+func TestWriteToDoesNotBlockConcurrentWrite(t *testing.T) {
+	p := NewBufferedPipe()
+	if _, err := p.Write([]byte("abcd")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	bw := &blockingWriter{release: make(chan struct{})}
+	writeToDone := make(chan struct{})
+	go func() {
+		p.WriteTo(bw)
+		close(writeToDone)
+	}()
+
+	// Give WriteTo a chance to snapshot "abcd" and enter the blocked w.Write call.
+	time.Sleep(20 * time.Millisecond)
+
+	concurrentWriteDone := make(chan struct{})
+	go func() {
+		if _, err := p.Write([]byte("efgh")); err != nil {
+			t.Error(err)
+		}
+		close(concurrentWriteDone)
+	}()
+
+	select {
+	case <-concurrentWriteDone:
+	case <-time.After(time.Second):
+		t.Fatal("Write() blocked on a concurrent WriteTo stuck inside w.Write, despite free ring capacity")
+	}
+
+	close(bw.release)
+	p.Close()
+	<-writeToDone
+}
+
+func BenchmarkBufferedPipeWrite(b *testing.B) {
+	p := NewBufferedPipe()
+	done := make(chan struct{})
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			if _, err := p.Read(buf); err != nil {
+				close(done)
+				return
+			}
+		}
+	}()
+
+	data := make([]byte, 4096)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := p.Write(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+	p.Close()
+	<-done
+}
+
+func BenchmarkBufferedPipeWriteTo(b *testing.B) {
+	p := NewBufferedPipe()
+	done := make(chan struct{})
+	go func() {
+		p.WriteTo(io.Discard)
+		close(done)
+	}()
+
+	data := make([]byte, 4096)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := p.Write(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+	p.Close()
+	<-done
+}
+
+// slowWriter models a consumer (e.g. a real socket) that takes measurable time per Write, so
+// this benchmark actually exercises contention between a stream's Write and its own WriteTo,
+// the scenario the single-stream, io.Discard-backed benchmarks above can't reach.
+type slowWriter struct{ delay time.Duration }
+
+func (w slowWriter) Write(b []byte) (int, error) {
+	time.Sleep(w.delay)
+	return len(b), nil
+}
+
+// BenchmarkBufferedPipeManyStreams runs many pipes concurrently, each with its own WriteTo
+// draining into a slowWriter while a 4096-byte Write lands on the same pipe, mirroring many
+// multiplexed streams each flushing to their own slow network connection at once.
+func BenchmarkBufferedPipeManyStreams(b *testing.B) {
+	const numStreams = 64
+	data := make([]byte, 4096)
+	b.SetBytes(int64(len(data)) * numStreams)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		pipes := make([]*bufferedPipe, numStreams)
+		dones := make([]chan struct{}, numStreams)
+		for s := range pipes {
+			pipes[s] = NewBufferedPipe()
+			dones[s] = make(chan struct{})
+			go func(p *bufferedPipe, done chan struct{}) {
+				p.WriteTo(slowWriter{delay: time.Microsecond})
+				close(done)
+			}(pipes[s], dones[s])
+		}
+		for s := range pipes {
+			if _, err := pipes[s].Write(data); err != nil {
+				b.Fatal(err)
+			}
+			pipes[s].Close()
+		}
+		for _, done := range dones {
+			<-done
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const extKeyShare uint16 = 0x0033
+
+// authGroupPreference lists the key share groups we know how to extract Cloak's authentication
+// ciphertext from, in the order we try them. A Chrome-family client now offers the hybrid
+// group first; older clients or other fingerprints only offer plain X25519.
+var authGroupPreference = []uint16{groupX25519Kyber768Draft00, groupX25519}
+
+// ExtractCiphertext locates Cloak's authentication ciphertext in a ClientHello handshake body
+// (the handshake message, not including the outer TLS record layer), trying each group in
+// authGroupPreference in turn. This replaces the old fixed-offset slice, which assumed every
+// client only ever offered a plain X25519 key share.
+//
+// The client splits the 64-byte ciphertext+tag across two fields (TLS.go's ObfsHandshake):
+// the first half rides in legacy_session_id, the second half in the key share's key_exchange
+// data. The two are reassembled here the same way the client reassembles the ServerHello's
+// reply (append(buf[6:38], buf[84:116]...)): legacy_session_id first, then the key share half.
+func ExtractCiphertext(handshakeBody []byte) ([]byte, error) {
+	sessionID, keyShareData, err := parseClientHello(handshakeBody, extKeyShare)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, group := range authGroupPreference {
+		ks, err := extractKeyShareEntry(keyShareData, group)
+		if err == nil {
+			return append(append([]byte{}, sessionID...), ks...), nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// ReadClientHelloCiphertext reads a single TLS record containing a ClientHello off r and
+// returns Cloak's authentication ciphertext extracted from its legacy_session_id and key_share
+// extension, as ExtractCiphertext does. r must be
+// positioned at the start of the TLS record layer, e.g. as returned by AcceptTransport.
+func ReadClientHelloCiphertext(r *bufio.Reader) ([]byte, error) {
+	recordHeader := make([]byte, 5)
+	if _, err := io.ReadFull(r, recordHeader); err != nil {
+		return nil, err
+	}
+	record := make([]byte, binary.BigEndian.Uint16(recordHeader[3:5]))
+	if _, err := io.ReadFull(r, record); err != nil {
+		return nil, err
+	}
+	if len(record) < 4 {
+		return nil, errors.New("server: handshake record too short")
+	}
+	handshakeLen := int(record[1])<<16 | int(record[2])<<8 | int(record[3])
+	if len(record) < 4+handshakeLen {
+		return nil, errors.New("server: handshake message truncated")
+	}
+	return ExtractCiphertext(record[4 : 4+handshakeLen])
+}
+
+// parseClientHello walks a ClientHello handshake body and returns both its legacy_session_id
+// bytes and the raw extension_data for the given extension type. Cloak's client splits its
+// authentication ciphertext across these two fields, so callers need both, not just the
+// extension.
+func parseClientHello(body []byte, extType uint16) (sessionID []byte, extData []byte, err error) {
+	pos := 2 // legacy_version
+	if len(body) < pos+32 {
+		return nil, nil, errors.New("server: ClientHello truncated before random")
+	}
+	pos += 32 // random
+
+	if len(body) < pos+1 {
+		return nil, nil, errors.New("server: ClientHello truncated before session id")
+	}
+	sessionIDLen := int(body[pos])
+	pos++
+	if len(body) < pos+sessionIDLen {
+		return nil, nil, errors.New("server: ClientHello session id truncated")
+	}
+	sessionID = body[pos : pos+sessionIDLen]
+	pos += sessionIDLen
+
+	if len(body) < pos+2 {
+		return nil, nil, errors.New("server: ClientHello truncated before cipher suites")
+	}
+	pos += 2 + int(binary.BigEndian.Uint16(body[pos:pos+2])) // cipher_suites
+
+	if len(body) < pos+1 {
+		return nil, nil, errors.New("server: ClientHello truncated before compression methods")
+	}
+	pos += 1 + int(body[pos]) // legacy_compression_methods
+
+	if len(body) < pos+2 {
+		return nil, nil, errors.New("server: ClientHello truncated before extensions")
+	}
+	extsLen := int(binary.BigEndian.Uint16(body[pos : pos+2]))
+	pos += 2
+	if len(body) < pos+extsLen {
+		return nil, nil, errors.New("server: ClientHello extensions truncated")
+	}
+	extsEnd := pos + extsLen
+
+	for pos+4 <= extsEnd {
+		t := binary.BigEndian.Uint16(body[pos : pos+2])
+		l := int(binary.BigEndian.Uint16(body[pos+2 : pos+4]))
+		dataStart := pos + 4
+		dataEnd := dataStart + l
+		if dataEnd > extsEnd {
+			return nil, nil, errors.New("server: ClientHello extension data truncated")
+		}
+		if t == extType {
+			return sessionID, body[dataStart:dataEnd], nil
+		}
+		pos = dataEnd
+	}
+	return nil, nil, errors.New("server: extension not present in ClientHello")
+}
+
+// extractKeyShareEntry scans a key_share extension's client_shares list for the given group
+// and returns the portion of its key_exchange data that carries Cloak's ciphertext, per
+// keyShareOffset.
+func extractKeyShareEntry(keyShareExtData []byte, group uint16) ([]byte, error) {
+	if len(keyShareExtData) < 2 {
+		return nil, errors.New("server: key_share client_shares truncated")
+	}
+	listLen := int(binary.BigEndian.Uint16(keyShareExtData[0:2]))
+	pos := 2
+	end := pos + listLen
+	if end > len(keyShareExtData) {
+		return nil, errors.New("server: key_share client_shares length mismatch")
+	}
+
+	for pos+4 <= end {
+		g := binary.BigEndian.Uint16(keyShareExtData[pos : pos+2])
+		keLen := int(binary.BigEndian.Uint16(keyShareExtData[pos+2 : pos+4]))
+		keStart := pos + 4
+		keEnd := keStart + keLen
+		if keEnd > end {
+			return nil, errors.New("server: key_share key_exchange truncated")
+		}
+		if g == group {
+			off, n, err := keyShareOffset(g)
+			if err != nil {
+				return nil, err
+			}
+			if off+n > keLen {
+				return nil, errors.New("server: key_exchange shorter than expected for group")
+			}
+			return keyShareExtData[keStart+off : keStart+off+n], nil
+		}
+		pos = keEnd
+	}
+	return nil, errors.New("server: no key share offered for requested group")
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// buildTestClientHello assembles a minimal but well-formed ClientHello handshake body (no
+// outer record layer) carrying a single key_share entry for group, with keyExchange as its
+// key_exchange data and sessionID as legacy_session_id.
+func buildTestClientHello(sessionID, keyExchange []byte, group uint16) []byte {
+	var body bytes.Buffer
+	body.Write([]byte{0x03, 0x03}) // legacy_version
+	body.Write(make([]byte, 32))   // random
+
+	body.WriteByte(byte(len(sessionID)))
+	body.Write(sessionID)
+
+	body.Write([]byte{0x00, 0x02, 0x13, 0x01}) // cipher_suites: one entry
+	body.Write([]byte{0x01, 0x00})             // legacy_compression_methods: null
+
+	var keyShareExt bytes.Buffer
+	var clientShares bytes.Buffer
+	groupBuf := make([]byte, 2)
+	binary.BigEndian.PutUint16(groupBuf, group)
+	clientShares.Write(groupBuf)
+	keLen := make([]byte, 2)
+	binary.BigEndian.PutUint16(keLen, uint16(len(keyExchange)))
+	clientShares.Write(keLen)
+	clientShares.Write(keyExchange)
+
+	listLen := make([]byte, 2)
+	binary.BigEndian.PutUint16(listLen, uint16(clientShares.Len()))
+	keyShareExt.Write(listLen)
+	keyShareExt.Write(clientShares.Bytes())
+
+	var exts bytes.Buffer
+	extType := make([]byte, 2)
+	binary.BigEndian.PutUint16(extType, extKeyShare)
+	exts.Write(extType)
+	extLen := make([]byte, 2)
+	binary.BigEndian.PutUint16(extLen, uint16(keyShareExt.Len()))
+	exts.Write(extLen)
+	exts.Write(keyShareExt.Bytes())
+
+	extsLen := make([]byte, 2)
+	binary.BigEndian.PutUint16(extsLen, uint16(exts.Len()))
+	body.Write(extsLen)
+	body.Write(exts.Bytes())
+
+	return body.Bytes()
+}
+
+// TestExtractCiphertextPlainX25519 checks that ExtractCiphertext reconstructs the full 64-byte
+// ciphertext+tag from a legacy_session_id/key_share split when the client only offers a plain
+// X25519 share.
+func TestExtractCiphertextPlainX25519(t *testing.T) {
+	sessionID := bytes.Repeat([]byte{0xaa}, 32)
+	keyExchange := bytes.Repeat([]byte{0xbb}, 32)
+	body := buildTestClientHello(sessionID, keyExchange, groupX25519)
+
+	got, err := ExtractCiphertext(body)
+	if err != nil {
+		t.Fatalf("ExtractCiphertext: %v", err)
+	}
+	want := append(append([]byte{}, sessionID...), keyExchange...)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("ExtractCiphertext = %x, want %x", got, want)
+	}
+}
+
+// TestExtractCiphertextHybrid checks the same reconstruction when the client offers the hybrid
+// X25519Kyber768Draft00 share, where only the leading classical component carries the
+// ciphertext half.
+func TestExtractCiphertextHybrid(t *testing.T) {
+	sessionID := bytes.Repeat([]byte{0xcc}, 32)
+	classical := bytes.Repeat([]byte{0xdd}, hybridClassicalKeyShareLen)
+	keyExchange := append(append([]byte{}, classical...), make([]byte, 1184)...)
+	body := buildTestClientHello(sessionID, keyExchange, groupX25519Kyber768Draft00)
+
+	got, err := ExtractCiphertext(body)
+	if err != nil {
+		t.Fatalf("ExtractCiphertext: %v", err)
+	}
+	want := append(append([]byte{}, sessionID...), classical...)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("ExtractCiphertext = %x, want %x", got, want)
+	}
+}
+
+func TestExtractCiphertextNoKeyShare(t *testing.T) {
+	body := buildTestClientHello(bytes.Repeat([]byte{0xaa}, 32), nil, 0)
+	// drop the 2-byte extensions length and the 10-byte key_share extension, then append an
+	// empty (zero-length) extensions block, so the ClientHello is well-formed but has no key_share
+	body = append(body[:len(body)-12], 0x00, 0x00)
+
+	if _, err := ExtractCiphertext(body); err == nil {
+		t.Fatal("ExtractCiphertext: expected error for ClientHello without key_share, got nil")
+	}
+}
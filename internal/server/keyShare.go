@@ -0,0 +1,35 @@
+package server
+
+import "errors"
+
+// TLS 1.3 NamedGroup IDs relevant to locating the key share carrying Cloak's authentication
+// ciphertext in an incoming ClientHello. https://datatracker.ietf.org/doc/html/rfc8446#section-4.2.7
+const (
+	groupX25519                uint16 = 0x001d
+	groupX25519Kyber768Draft00 uint16 = 0x6399
+)
+
+// keyShareLens maps a negotiated NamedGroup to the length, in bytes, of its key_exchange data.
+// Previously the server assumed a fixed X25519-only ClientHello and sliced the key share at a
+// hardcoded offset; this breaks as soon as a client (e.g. Chrome with its default hybrid
+// post-quantum share) sends a different group first. The first hybridClassicalKeyShareLen bytes
+// of the hybrid share hold the same data an X25519-only share would, so that's all the caller
+// needs to extract the authentication ciphertext.
+var keyShareLens = map[uint16]int{
+	groupX25519:                32,
+	groupX25519Kyber768Draft00: 1216,
+}
+
+const hybridClassicalKeyShareLen = 32
+
+// keyShareOffset locates the authentication-bearing portion of a key_exchange value for the
+// given negotiated group within a ClientHello's key_share extension. off is the offset into the
+// key_exchange data at which the ciphertext begins, and n is how many bytes to read from there.
+func keyShareOffset(group uint16) (off int, n int, err error) {
+	if _, ok := keyShareLens[group]; !ok {
+		return 0, 0, errors.New("keyShareOffset: unsupported key share group")
+	}
+	// Both supported groups carry the ciphertext at the very start of the key_exchange data;
+	// for the hybrid group this is its classical (X25519) component.
+	return 0, hybridClassicalKeyShareLen, nil
+}
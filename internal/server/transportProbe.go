@@ -0,0 +1,57 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+)
+
+// transportKind mirrors client.TransportKind on the server side, without depending on the
+// client package.
+type transportKind int
+
+const (
+	transportDirectTLS transportKind = iota
+	transportWebSocket
+)
+
+// probeTransport looks at the first bytes read from a new connection and decides which
+// Transport's ObfsHandshake the client used, so the server can parse the rest of the handshake
+// accordingly instead of assuming TLS. A TLS record starts with content type 0x16 (handshake);
+// bytes starting with "GET " are the WebSocket disguise. Anything else is treated as TLS.
+func probeTransport(firstBytes []byte) transportKind {
+	if len(firstBytes) > 0 && firstBytes[0] == 0x16 {
+		return transportDirectTLS
+	}
+	if bytes.HasPrefix(firstBytes, []byte("GET ")) {
+		return transportWebSocket
+	}
+	return transportDirectTLS
+}
+
+// AcceptTransport is the server-side entry point for a newly accepted connection: it peeks at
+// the first bytes without consuming them, calls probeTransport to decide which disguise the
+// client used, and branches parsing accordingly. For the DirectTLS disguise it reads the
+// ClientHello and extracts Cloak's authentication ciphertext via ReadClientHelloCiphertext,
+// which locates the ciphertext by the negotiated key share's group ID rather than a hardcoded
+// offset. For the WebSocket disguise it parses the upgrade request via ParseWebSocketUpgrade.
+// wsKey is only set for the WebSocket case; once the caller has derived a session key to reply
+// with, it completes the handshake with WriteWebSocketAccept(conn, wsKey, ...).
+func AcceptTransport(conn net.Conn) (kind transportKind, ciphertext []byte, wsKey string, err error) {
+	r := bufio.NewReader(conn)
+	peek, err := r.Peek(4)
+	if err != nil {
+		return transportDirectTLS, nil, "", err
+	}
+	switch kind = probeTransport(peek); kind {
+	case transportDirectTLS:
+		ciphertext, err = ReadClientHelloCiphertext(r)
+		return kind, ciphertext, "", err
+	case transportWebSocket:
+		ciphertext, wsKey, err = ParseWebSocketUpgrade(r)
+		return kind, ciphertext, wsKey, err
+	default:
+		return kind, nil, "", errors.New("server: unrecognised transport")
+	}
+}
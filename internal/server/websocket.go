@@ -0,0 +1,84 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// wsMagicGUID is the fixed GUID RFC 6455 uses to derive Sec-WebSocket-Accept from
+// Sec-WebSocket-Key. https://datatracker.ietf.org/doc/html/rfc6455#section-1.3
+const wsMagicGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// ParseWebSocketUpgrade reads an HTTP upgrade request off r and reconstructs Cloak's
+// authentication ciphertext, the WebSocket-disguise counterpart to ReadClientHelloCiphertext.
+// client.WebSocketUpgrade.ObfsHandshake splits the ciphertext+tag across two fields, as DirectTLS
+// does for TLS, but at a different point: the first 16 bytes ride in Sec-WebSocket-Key, the
+// remaining 48 in a "sid" cookie. wsKey is
+// returned alongside so the caller can compute Sec-WebSocket-Accept once it has a session key to
+// reply with, via WriteWebSocketAccept.
+func ParseWebSocketUpgrade(r *bufio.Reader) (ciphertext []byte, wsKey string, err error) {
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return nil, "", err
+	}
+	defer req.Body.Close()
+
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") ||
+		!strings.Contains(strings.ToLower(req.Header.Get("Connection")), "upgrade") {
+		return nil, "", errors.New("server: not a websocket upgrade request")
+	}
+
+	wsKey = req.Header.Get("Sec-WebSocket-Key")
+	if wsKey == "" {
+		return nil, "", errors.New("server: missing Sec-WebSocket-Key")
+	}
+	keyHalf, err := base64.StdEncoding.DecodeString(wsKey)
+	if err != nil || len(keyHalf) != 16 {
+		return nil, "", errors.New("server: malformed Sec-WebSocket-Key")
+	}
+
+	sidCookie, err := req.Cookie("sid")
+	if err != nil {
+		return nil, "", errors.New("server: missing sid cookie")
+	}
+	cookieHalf, err := base64.StdEncoding.DecodeString(sidCookie.Value)
+	if err != nil || len(cookieHalf) != 48 {
+		return nil, "", errors.New("server: malformed sid cookie")
+	}
+
+	return append(append([]byte{}, keyHalf...), cookieHalf...), wsKey, nil
+}
+
+// WriteWebSocketAccept writes the 101 Switching Protocols response that completes a WebSocket
+// upgrade disguise: Sec-WebSocket-Accept is computed from wsKey as RFC 6455 requires (so a
+// censor doing real protocol validation sees a compliant handshake), and encryptedSessionKey
+// (a nonce plus AES-GCM-sealed session key, the same 60-byte shape client.WebSocketUpgrade
+// decrypts out of its sid cookie) rides back the same way the client sent its half: in a cookie.
+func WriteWebSocketAccept(w io.Writer, wsKey string, encryptedSessionKey []byte) error {
+	resp := fmt.Sprintf(
+		"HTTP/1.1 101 Switching Protocols\r\n"+
+			"Upgrade: websocket\r\n"+
+			"Connection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: %s\r\n"+
+			"Set-Cookie: sid=%s\r\n"+
+			"\r\n",
+		wsAcceptKey(wsKey), base64.StdEncoding.EncodeToString(encryptedSessionKey),
+	)
+	_, err := io.WriteString(w, resp)
+	return err
+}
+
+// wsAcceptKey computes the Sec-WebSocket-Accept value for a given Sec-WebSocket-Key, mirroring
+// client.wsAcceptKey so the client can verify it.
+func wsAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key))
+	h.Write([]byte(wsMagicGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParseWebSocketUpgradeRoundTrip(t *testing.T) {
+	keyHalf := bytes.Repeat([]byte{0xaa}, 16)
+	cookieHalf := bytes.Repeat([]byte{0xbb}, 48)
+	wsKey := base64.StdEncoding.EncodeToString(keyHalf)
+	cookie := base64.StdEncoding.EncodeToString(cookieHalf)
+
+	req := "GET /ws HTTP/1.1\r\n" +
+		"Host: www.example.com\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + wsKey + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"Cookie: sid=" + cookie + "\r\n" +
+		"\r\n"
+
+	ciphertext, gotKey, err := ParseWebSocketUpgrade(bufio.NewReader(strings.NewReader(req)))
+	if err != nil {
+		t.Fatalf("ParseWebSocketUpgrade: %v", err)
+	}
+	if gotKey != wsKey {
+		t.Errorf("wsKey = %q, want %q", gotKey, wsKey)
+	}
+	want := append(append([]byte{}, keyHalf...), cookieHalf...)
+	if !bytes.Equal(ciphertext, want) {
+		t.Errorf("ciphertext = %x, want %x", ciphertext, want)
+	}
+}
+
+func TestParseWebSocketUpgradeRejectsNonUpgrade(t *testing.T) {
+	req := "GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"
+	if _, _, err := ParseWebSocketUpgrade(bufio.NewReader(strings.NewReader(req))); err == nil {
+		t.Fatal("ParseWebSocketUpgrade: expected error for a plain GET, got nil")
+	}
+}
+
+func TestWriteWebSocketAcceptMatchesClientComputation(t *testing.T) {
+	wsKey := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0x01}, 16))
+	sessionKeyPayload := bytes.Repeat([]byte{0x02}, 60)
+
+	var buf bytes.Buffer
+	if err := WriteWebSocketAccept(&buf, wsKey, sessionKeyPayload); err != nil {
+		t.Fatalf("WriteWebSocketAccept: %v", err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf.Bytes())), nil)
+	if err != nil {
+		t.Fatalf("reading response: %v", err)
+	}
+	if resp.StatusCode != 101 {
+		t.Fatalf("status = %d, want 101", resp.StatusCode)
+	}
+	if got, want := resp.Header.Get("Sec-WebSocket-Accept"), wsAcceptKey(wsKey); got != want {
+		t.Errorf("Sec-WebSocket-Accept = %q, want %q", got, want)
+	}
+	var sid string
+	for _, c := range resp.Cookies() {
+		if c.Name == "sid" {
+			sid = c.Value
+		}
+	}
+	decoded, err := base64.StdEncoding.DecodeString(sid)
+	if err != nil {
+		t.Fatalf("decoding sid cookie: %v", err)
+	}
+	if !bytes.Equal(decoded, sessionKeyPayload) {
+		t.Errorf("sid cookie = %x, want %x", decoded, sessionKeyPayload)
+	}
+}